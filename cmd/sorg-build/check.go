@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	log "github.com/Sirupsen/logrus"
+	"github.com/brandur/sorg"
+)
+
+// brokenLink records a single internal or external reference found on a
+// compiled page that didn't resolve.
+type brokenLink struct {
+	SourcePage string
+	Target     string
+}
+
+// runCheck walks every compiled HTML page under sorg.TargetDir, verifies
+// that its internal hrefs/srcs/srcsets resolve to a file that was actually
+// produced by the build (or a symlink from linkImageAssets), and, when
+// conf.CheckExternal is set, HEAD-requests external URLs as well. It
+// returns a non-nil error (and logs a report grouped by source page) if
+// any broken link was found.
+func runCheck() error {
+	var htmlFiles []string
+
+	err := filepath.Walk(sorg.TargetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// renderView writes compiled pages without an extension (e.g.
+		// "articles/<slug>", "runs"), so those count as HTML pages too.
+		// Symlinked assets from linkImageAssets are not regular files and
+		// are skipped.
+		ext := filepath.Ext(path)
+		if info.Mode().IsRegular() && (ext == "" || ext == ".html") {
+			htmlFiles = append(htmlFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var broken []brokenLink
+	externalSources := make(map[string][]string)
+
+	for _, htmlFile := range htmlFiles {
+		file, err := os.Open(htmlFile)
+		if err != nil {
+			return err
+		}
+
+		doc, err := goquery.NewDocumentFromReader(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error parsing %v: %v", htmlFile, err)
+		}
+
+		for _, target := range extractLinkTargets(doc) {
+			if isExternalTarget(target) {
+				externalSources[target] = append(externalSources[target], htmlFile)
+				continue
+			}
+
+			if !internalTargetExists(htmlFile, target) {
+				broken = append(broken, brokenLink{SourcePage: htmlFile, Target: target})
+			}
+		}
+	}
+
+	if conf.CheckExternal {
+		externalBroken, err := checkExternalTargets(externalSources)
+		if err != nil {
+			return err
+		}
+		broken = append(broken, externalBroken...)
+	}
+
+	if len(broken) == 0 {
+		log.Info("check: no broken links found")
+		return nil
+	}
+
+	reportBrokenLinks(broken)
+	return fmt.Errorf("check: %d broken link(s) found", len(broken))
+}
+
+// extractLinkTargets pulls every href, src, and srcset candidate out of a
+// compiled page.
+func extractLinkTargets(doc *goquery.Document) []string {
+	var targets []string
+
+	doc.Find("[href]").Each(func(_ int, s *goquery.Selection) {
+		if href, ok := s.Attr("href"); ok {
+			targets = append(targets, href)
+		}
+	})
+
+	doc.Find("[src]").Each(func(_ int, s *goquery.Selection) {
+		if src, ok := s.Attr("src"); ok {
+			targets = append(targets, src)
+		}
+	})
+
+	doc.Find("[srcset]").Each(func(_ int, s *goquery.Selection) {
+		srcset, ok := s.Attr("srcset")
+		if !ok {
+			return
+		}
+
+		for _, candidate := range strings.Split(srcset, ",") {
+			fields := strings.Fields(strings.TrimSpace(candidate))
+			if len(fields) > 0 {
+				targets = append(targets, fields[0])
+			}
+		}
+	})
+
+	return targets
+}
+
+// isExternalTarget reports whether target points off-site.
+func isExternalTarget(target string) bool {
+	return strings.HasPrefix(target, "http://") ||
+		strings.HasPrefix(target, "https://") ||
+		strings.HasPrefix(target, "//") ||
+		strings.HasPrefix(target, "mailto:")
+}
+
+// internalTargetExists reports whether target resolves to a file under
+// sorg.TargetDir. A target starting with "/" is resolved relative to the
+// site root; any other target is page-relative and is resolved against the
+// directory of htmlFile instead.
+func internalTargetExists(htmlFile, target string) bool {
+	if i := strings.IndexAny(target, "#?"); i >= 0 {
+		target = target[:i]
+	}
+
+	if target == "" {
+		// An empty or fragment/query-only href points back at the page
+		// itself.
+		return true
+	}
+
+	var resolved string
+	if strings.HasPrefix(target, "/") {
+		resolved = sorg.TargetDir + strings.TrimPrefix(target, "/")
+	} else {
+		resolved = filepath.Join(filepath.Dir(htmlFile), target)
+	}
+
+	_, err := os.Stat(resolved)
+	return err == nil
+}
+
+// reportBrokenLinks logs every broken link, grouped by the page it was
+// found on.
+func reportBrokenLinks(broken []brokenLink) {
+	byPage := make(map[string][]string)
+	for _, b := range broken {
+		byPage[b.SourcePage] = append(byPage[b.SourcePage], b.Target)
+	}
+
+	var pages []string
+	for page := range byPage {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	for _, page := range pages {
+		log.Errorf("%v:", page)
+		for _, target := range byPage[page] {
+			log.Errorf("  broken: %v", target)
+		}
+	}
+}
+
+// externalCacheEntry is a cached HEAD result for a previously checked
+// external URL, persisted across runs and keyed by URL. CheckedAt lets a
+// stale entry expire after externalCacheTTL even if it was OK, and ETag
+// (when the server sent one) is replayed as If-None-Match so that a
+// revalidation can come back as a cheap 304 instead of a full re-check.
+type externalCacheEntry struct {
+	ETag      string    `json:"etag"`
+	OK        bool      `json:"ok"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// externalLinkRateLimit is the minimum spacing between requests made to a
+// single host.
+const externalLinkRateLimit = 200 * time.Millisecond
+
+// externalLinkWorkers is the size of the bounded worker pool used to check
+// external URLs concurrently.
+const externalLinkWorkers = 8
+
+// externalCacheTTL is how long a cached "OK" result is trusted before it's
+// re-verified, so that a link that broke after it was last checked doesn't
+// stay marked as good forever.
+const externalCacheTTL = 7 * 24 * time.Hour
+
+// checkExternalTargets HEAD-requests each external URL found across the
+// site (every URL once, regardless of how many pages reference it) and
+// returns a brokenLink for every source page referencing one that didn't
+// resolve. A cached OK result is trusted (and revalidated with
+// If-None-Match when an ETag is available) until it's older than
+// externalCacheTTL, so a link that breaks after it was last checked is
+// eventually re-verified rather than cached as good forever.
+func checkExternalTargets(sources map[string][]string) ([]brokenLink, error) {
+	cache := loadExternalLinkCache()
+	defer saveExternalLinkCache(cache)
+
+	now := time.Now()
+
+	type job struct {
+		url     string
+		sources []string
+		etag    string
+	}
+
+	jobs := make(chan job)
+	results := make(chan brokenLink)
+
+	var cacheMu sync.Mutex
+	var limiters sync.Map // host (string) -> *time.Ticker
+
+	limiterFor := func(host string) *time.Ticker {
+		if t, ok := limiters.Load(host); ok {
+			return t.(*time.Ticker)
+		}
+
+		t := time.NewTicker(externalLinkRateLimit)
+		actual, _ := limiters.LoadOrStore(host, t)
+		return actual.(*time.Ticker)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < externalLinkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := range jobs {
+				<-limiterFor(hostOf(j.url)).C
+
+				ok, notModified, etag := headExternalURL(j.url, j.etag)
+
+				if notModified {
+					cacheMu.Lock()
+					entry := cache[j.url]
+					entry.CheckedAt = now
+					cache[j.url] = entry
+					cacheMu.Unlock()
+
+					// The cached verdict stands, including a broken one.
+					ok = entry.OK
+				} else {
+					cacheMu.Lock()
+					cache[j.url] = externalCacheEntry{ETag: etag, OK: ok, CheckedAt: now}
+					cacheMu.Unlock()
+				}
+
+				if !ok {
+					for _, source := range j.sources {
+						results <- brokenLink{SourcePage: source, Target: j.url}
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	go func() {
+		defer close(jobs)
+
+		for target, pages := range sources {
+			cacheMu.Lock()
+			entry, ok := cache[target]
+			cacheMu.Unlock()
+
+			if ok && entry.OK && now.Sub(entry.CheckedAt) < externalCacheTTL {
+				continue
+			}
+
+			etag := ""
+			if ok {
+				etag = entry.ETag
+			}
+			jobs <- job{url: target, sources: pages, etag: etag}
+		}
+	}()
+
+	var broken []brokenLink
+	for result := range results {
+		broken = append(broken, result)
+	}
+
+	return broken, nil
+}
+
+// headExternalURL issues a HEAD request for target and reports whether it
+// resolved successfully, along with its ETag (if any) for cache storage. If
+// ifNoneMatch is non-empty, it's sent as an If-None-Match precondition; a
+// 304 response is reported back via notModified so the caller can refresh
+// the cached entry's timestamp without treating it as a fresh check.
+func headExternalURL(target, ifNoneMatch string) (ok, notModified bool, etag string) {
+	req, err := http.NewRequest(http.MethodHead, target, nil)
+	if err != nil {
+		return false, false, ""
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Debugf("check: error requesting %v: %v", target, err)
+		return false, false, ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return true, true, ifNoneMatch
+	}
+
+	return resp.StatusCode < 400, false, resp.Header.Get("ETag")
+}
+
+// hostOf extracts the host component of a URL for rate-limiting purposes.
+func hostOf(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// externalLinkCachePath is where the external link cache is persisted
+// between runs.
+func externalLinkCachePath() string {
+	return sorg.TargetDir + ".external-link-cache.json"
+}
+
+func loadExternalLinkCache() map[string]externalCacheEntry {
+	cache := make(map[string]externalCacheEntry)
+
+	data, err := ioutil.ReadFile(externalLinkCachePath())
+	if err != nil {
+		return cache
+	}
+
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return make(map[string]externalCacheEntry)
+	}
+
+	return cache
+}
+
+func saveExternalLinkCache(cache map[string]externalCacheEntry) {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if err := ioutil.WriteFile(externalLinkCachePath(), data, 0644); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"time"
+
+	"github.com/brandur/sorg"
+)
+
+// atomXmlns is the XML namespace for the Atom 1.0 syndication format as
+// specified by RFC 4287.
+const atomXmlns = "http://www.w3.org/2005/Atom"
+
+// Feed is a top-level Atom 1.0 feed document.
+type Feed struct {
+	XMLName xml.Name     `xml:"feed"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Author  *FeedAuthor  `xml:"author"`
+	Links   []FeedLink   `xml:"link"`
+	Entries []*FeedEntry `xml:"entry"`
+}
+
+// FeedAuthor identifies the author of a feed or entry.
+type FeedAuthor struct {
+	Name string `xml:"name"`
+}
+
+// FeedLink is a <link> element as found in a Feed or FeedEntry.
+type FeedLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+// FeedEntry is a single <entry> within a Feed.
+type FeedEntry struct {
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Links   []FeedLink   `xml:"link"`
+	Content *FeedContent `xml:"content"`
+}
+
+// FeedContent is the <content> element of a FeedEntry. It carries the
+// entry's rendered HTML content inline.
+type FeedContent struct {
+	Type    string `xml:"type,attr"`
+	Content string `xml:",cdata"`
+}
+
+// compileArticlesFeed generates an Atom feed of articles and writes it out
+// to articles.atom in the target directory.
+func compileArticlesFeed(articles []*Article) error {
+	var entries []*FeedEntry
+
+	for _, article := range articles {
+		path := "/" + article.Slug
+
+		entries = append(entries, &FeedEntry{
+			ID:      makeTagURI(conf.FeedDomain, conf.FeedStartDate, path),
+			Title:   article.Title,
+			Updated: article.PublishedAt.Format(time.RFC3339),
+			Links: []FeedLink{
+				{Href: "https://" + conf.FeedDomain + path},
+			},
+			Content: &FeedContent{
+				Type:    "html",
+				Content: article.Content,
+			},
+		})
+	}
+
+	return writeAtomFeed(sorg.TargetDir+"articles.atom", "/articles.atom", entries)
+}
+
+// compileFragmentsFeed generates an Atom feed of fragments and writes it out
+// to fragments.atom in the target directory.
+func compileFragmentsFeed(fragments []*Fragment) error {
+	var entries []*FeedEntry
+
+	for _, fragment := range fragments {
+		path := "/fragments/" + fragment.Slug
+
+		entries = append(entries, &FeedEntry{
+			ID:      makeTagURI(conf.FeedDomain, conf.FeedStartDate, path),
+			Title:   fragment.Title,
+			Updated: fragment.PublishedAt.Format(time.RFC3339),
+			Links: []FeedLink{
+				{Href: "https://" + conf.FeedDomain + path},
+			},
+			Content: &FeedContent{
+				Type:    "html",
+				Content: fragment.Content,
+			},
+		})
+	}
+
+	return writeAtomFeed(sorg.TargetDir+"fragments.atom", "/fragments.atom", entries)
+}
+
+// makeTagURI builds a tag URI as described by RFC 4151. domain and
+// startDate identify the entity that minted the tag (startDate being the
+// date on which domain came under that entity's control), and specific
+// disambiguates the particular resource being tagged. Tag URIs make for
+// feed entry IDs that are stable even if a page's URL later changes.
+func makeTagURI(domain, startDate, specific string) string {
+	return "tag:" + domain + "," + startDate + ":" + specific
+}
+
+// writeAtomFeed renders entries as an Atom 1.0 feed to target. selfPath is
+// the feed's own path (e.g. "/articles.atom"), used for its self-referencing
+// link and to help seed its tag URI.
+func writeAtomFeed(target, selfPath string, entries []*FeedEntry) error {
+	var updated time.Time
+	for _, entry := range entries {
+		t, err := time.Parse(time.RFC3339, entry.Updated)
+		if err == nil && t.After(updated) {
+			updated = t
+		}
+	}
+
+	feed := &Feed{
+		Xmlns:   atomXmlns,
+		ID:      makeTagURI(conf.FeedDomain, conf.FeedStartDate, selfPath),
+		Title:   conf.FeedTitle,
+		Updated: updated.Format(time.RFC3339),
+		Author:  &FeedAuthor{Name: conf.FeedAuthorName},
+		Links: []FeedLink{
+			{Href: "https://" + conf.FeedDomain + selfPath, Rel: "self"},
+			{Href: "https://" + conf.FeedDomain + "/"},
+		},
+		Entries: entries,
+	}
+
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(xml.Header)
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(file)
+	encoder.Indent("", "  ")
+	return encoder.Encode(feed)
+}
@@ -2,24 +2,31 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/brandur/sorg"
+	"github.com/brandur/sorg/markup"
 	"github.com/brandur/sorg/templatehelpers"
 	"github.com/joeshaw/envdecode"
 	_ "github.com/lib/pq"
-	"github.com/russross/blackfriday"
 	"github.com/yosssi/ace"
 	"github.com/yosssi/gcss"
+	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
 )
 
@@ -50,6 +57,12 @@ type Article struct {
 	// rendered, and then added separately.
 	Content string `yaml:"-"`
 
+	// Draft indicates that the article is not yet published. Draft articles
+	// are excluded from the build entirely unless INCLUDE_DRAFTS is set, in
+	// which case they're rendered under a private "drafts/" subtree marked
+	// noindex instead of their usual target location.
+	Draft bool `yaml:"draft"`
+
 	// HNLink is an optional link to comments on Hacker News.
 	HNLink string `yaml:"hn_link"`
 
@@ -59,9 +72,21 @@ type Article struct {
 	// Image is an optional image that may be included with an article.
 	Image string `yaml:"image"`
 
-	// PublishedAt is when the article was published.
+	// ModTime is the modification time of the article's source file. It
+	// isn't included as YAML frontmatter, and is only used to order the
+	// drafts index.
+	ModTime time.Time `yaml:"-"`
+
+	// PublishedAt is when the article was published. Articles with a
+	// PublishedAt in the future are excluded from the build unless
+	// INCLUDE_SCHEDULED is set.
 	PublishedAt *time.Time `yaml:"published_at"`
 
+	// Slug is a unique identifier for the article that also corresponds to its
+	// path under the target directory. It isn't included as YAML
+	// frontmatter, but rather calculated from the article's filename.
+	Slug string `yaml:"-"`
+
 	// Title is the article's title.
 	Title string `yaml:"title"`
 
@@ -77,9 +102,42 @@ type Conf struct {
 	// in order to extract books, tweets, runs, etc.
 	BlackSwanDatabaseURL string `env:"BLACK_SWAN_DATABASE_URL"`
 
+	// FeedAuthorName is the name attributed as the author in generated Atom
+	// feeds.
+	FeedAuthorName string `env:"FEED_AUTHOR_NAME"`
+
+	// FeedDomain is the canonical domain that the site is served from. It's
+	// used to build feed entries' self-referencing links and tag URIs.
+	FeedDomain string `env:"FEED_DOMAIN"`
+
+	// FeedStartDate is the date (in YYYY-MM-DD form) on which FeedDomain came
+	// under the author's control. It's the date component required by the
+	// tag URI scheme (RFC 4151) used to mint stable feed entry IDs.
+	FeedStartDate string `env:"FEED_START_DATE"`
+
+	// FeedTitle is the title used for generated Atom feeds.
+	FeedTitle string `env:"FEED_TITLE,default=sorg"`
+
 	// GoogleAnalyticsID is the account identifier for Google Analytics to use.
 	GoogleAnalyticsID string `env:"GOOGLE_ANALYTICS_ID"`
 
+	// CheckExternal, when set along with the check subcommand/flag, causes
+	// external links found in compiled pages to be checked with HEAD
+	// requests in addition to the on-disk check of internal ones.
+	CheckExternal bool `env:"CHECK_EXTERNAL,default=false"`
+
+	// IncludeDrafts, when true, causes draft articles and fragments to be
+	// rendered (to a private "drafts/" subtree) instead of being skipped.
+	IncludeDrafts bool `env:"INCLUDE_DRAFTS,default=false"`
+
+	// IncludeScheduled, when true, causes articles and fragments whose
+	// PublishedAt is in the future to be rendered instead of being skipped.
+	IncludeScheduled bool `env:"INCLUDE_SCHEDULED,default=false"`
+
+	// MarkupEngine selects the markup.Converter used to render Markdown
+	// content. Valid values are "blackfriday" (the default) and "goldmark".
+	MarkupEngine string `env:"MARKUP_ENGINE,default=blackfriday"`
+
 	// Verbose is whether the program will print debug output as it's running.
 	Verbose bool `env:"VERBOSE,default=false"`
 }
@@ -92,12 +150,27 @@ type Fragment struct {
 	// rendered, and then added separately.
 	Content string `yaml:"-"`
 
+	// Draft indicates that the fragment is not yet published. See
+	// Article.Draft for how drafts are handled during the build.
+	Draft bool `yaml:"draft"`
+
 	// Image is an optional image that may be included with a fragment.
 	Image string `yaml:"image"`
 
-	// PublishedAt is when the fragment was published.
+	// ModTime is the modification time of the fragment's source file. It
+	// isn't included as YAML frontmatter, and is only used to order the
+	// drafts index.
+	ModTime time.Time `yaml:"-"`
+
+	// PublishedAt is when the fragment was published. See
+	// Article.PublishedAt for how scheduled publication is handled.
 	PublishedAt *time.Time `yaml:"published_at"`
 
+	// Slug is a unique identifier for the fragment that also corresponds to
+	// its path under the target directory. It isn't included as YAML
+	// frontmatter, but rather calculated from the fragment's filename.
+	Slug string `yaml:"-"`
+
 	// Title is the fragment's title.
 	Title string `yaml:"title"`
 }
@@ -116,6 +189,10 @@ type Run struct {
 
 var conf Conf
 
+// converter is the markup.Converter used to render Markdown content,
+// selected at startup according to conf.MarkupEngine.
+var converter markup.Converter
+
 func main() {
 	err := envdecode.Decode(&conf)
 	if err != nil {
@@ -124,142 +201,450 @@ func main() {
 
 	sorg.InitLog(conf.Verbose)
 
-	err = sorg.CreateTargetDirs()
-	if err != nil {
-		log.Fatal(err)
+	switch conf.MarkupEngine {
+	case "goldmark":
+		converter = markup.NewGoldmarkConverter()
+	case "blackfriday", "":
+		converter = markup.NewBlackfridayConverter()
+	default:
+		log.Fatalf("Unknown markup engine: %v", conf.MarkupEngine)
 	}
 
-	err = compileArticles()
-	if err != nil {
-		log.Fatal(err)
-	}
+	checkFlag := flag.Bool("check", false, "Check generated output for broken links and assets after building")
+	flag.Parse()
 
-	err = compileFragments()
-	if err != nil {
-		log.Fatal(err)
-	}
+	switch flag.Arg(0) {
+	case "serve":
+		err = serve()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 
-	err = compileRuns()
-	if err != nil {
-		log.Fatal(err)
+	case "check":
+		err = build()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = runCheck()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err = compileStylesheets()
+	err = build()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = linkImageAssets()
-	if err != nil {
-		log.Fatal(err)
+	if *checkFlag {
+		err = runCheck()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 }
 
-func compileArticles() error {
-	articleInfos, err := ioutil.ReadDir(sorg.ArticlesDir)
+// build runs a full compile of the site: articles, fragments, and runs are
+// compiled concurrently via errgroup since none of them depend on each
+// other's output, then their feeds, the stylesheet bundle, and image
+// assets follow.
+func build() error {
+	err := sorg.CreateTargetDirs()
 	if err != nil {
 		return err
 	}
 
-	for _, articleInfo := range articleInfos {
-		inPath := sorg.ArticlesDir + articleInfo.Name()
-		log.Debugf("Compiling: %v", inPath)
-
-		outName := strings.Replace(articleInfo.Name(), ".md", "", -1)
-
-		raw, err := ioutil.ReadFile(inPath)
+	if conf.IncludeDrafts {
+		err = os.MkdirAll(sorg.TargetDir+"drafts/articles", 0755)
 		if err != nil {
 			return err
 		}
 
-		frontmatter, content, err := splitFrontmatter(string(raw))
+		err = os.MkdirAll(sorg.TargetDir+"drafts/fragments", 0755)
 		if err != nil {
 			return err
 		}
+	}
+
+	var articles []*Article
+	var fragments []*Fragment
+
+	group, _ := errgroup.WithContext(context.Background())
+
+	group.Go(func() error {
+		var err error
+		articles, err = compileArticles("")
+		return err
+	})
+
+	group.Go(func() error {
+		var err error
+		fragments, err = compileFragments("")
+		return err
+	})
+
+	group.Go(compileRuns)
+
+	err = group.Wait()
+	if err != nil {
+		return err
+	}
+
+	publicArticles, draftArticles := partitionArticleDrafts(articles)
+	publicFragments, draftFragments := partitionFragmentDrafts(fragments)
 
-		var article Article
-		err = yaml.Unmarshal([]byte(frontmatter), &article)
+	err = compileArticlesFeed(publicArticles)
+	if err != nil {
+		return err
+	}
+
+	err = compileFragmentsFeed(publicFragments)
+	if err != nil {
+		return err
+	}
+
+	if conf.IncludeDrafts {
+		err = compileDraftsIndex(draftArticles, draftFragments)
 		if err != nil {
 			return err
 		}
+	}
+
+	err = compileStylesheets()
+	if err != nil {
+		return err
+	}
 
-		if article.Title == "" {
-			return fmt.Errorf("No title for article: %v", inPath)
+	err = linkImageAssets()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// partitionArticleDrafts splits articles into those that are publicly
+// visible and those rendered under the private drafts subtree.
+func partitionArticleDrafts(articles []*Article) (public, drafts []*Article) {
+	for _, article := range articles {
+		if article.Draft {
+			drafts = append(drafts, article)
+		} else {
+			public = append(public, article)
 		}
+	}
+	return public, drafts
+}
 
-		if article.PublishedAt == nil {
-			return fmt.Errorf("No publish date for article: %v", inPath)
+// partitionFragmentDrafts splits fragments into those that are publicly
+// visible and those rendered under the private drafts subtree.
+func partitionFragmentDrafts(fragments []*Fragment) (public, drafts []*Fragment) {
+	for _, fragment := range fragments {
+		if fragment.Draft {
+			drafts = append(drafts, fragment)
+		} else {
+			public = append(public, fragment)
 		}
+	}
+	return public, drafts
+}
 
-		article.Content = string(renderMarkdown([]byte(content)))
+// compileDraftsIndex renders the private index of draft articles and
+// fragments to drafts/index, sorted by source file modification time (most
+// recently touched first).
+func compileDraftsIndex(articles []*Article, fragments []*Fragment) error {
+	sort.Slice(articles, func(i, j int) bool {
+		return articles[i].ModTime.After(articles[j].ModTime)
+	})
 
-		// TODO: Need a TOC!
-		article.TOC = ""
+	sort.Slice(fragments, func(i, j int) bool {
+		return fragments[i].ModTime.After(fragments[j].ModTime)
+	})
 
-		locals := getLocals(article.Title, map[string]interface{}{
-			"Article": article,
-		})
+	locals := getLocals("Drafts", map[string]interface{}{
+		"DraftArticles":  articles,
+		"DraftFragments": fragments,
+		"NoIndex":        true,
+	})
 
-		err = renderView(sorg.LayoutsDir+"main", sorg.ViewsDir+"/articles/show",
-			sorg.TargetArticlesDir+outName, locals)
-		if err != nil {
-			return err
+	return renderView(sorg.LayoutsDir+"main", sorg.ViewsDir+"/drafts/index",
+		sorg.TargetDir+"drafts/index", locals)
+}
+
+// compileArticles compiles every article under sorg.ArticlesDir, or just
+// onlyFile if it's non-empty (used for incremental rebuilds from the
+// `serve` command). Individual articles are compiled concurrently, bounded
+// by a semaphore sized to GOMAXPROCS; whichever goroutine's error reaches
+// errgroup first is the one returned (not necessarily the first file in
+// directory order), and it cancels the rest, while errors from any other
+// in-flight articles are merely logged.
+func compileArticles(onlyFile string) ([]*Article, error) {
+	articleInfos, err := ioutil.ReadDir(sorg.ArticlesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	articles := make([]*Article, len(articleInfos))
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+
+	group, ctx := errgroup.WithContext(context.Background())
+
+	for i, articleInfo := range articleInfos {
+		i := i
+		inPath := sorg.ArticlesDir + articleInfo.Name()
+
+		if onlyFile != "" && inPath != onlyFile {
+			continue
 		}
+
+		group.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+
+			article, err := compileArticle(inPath)
+			if err != nil {
+				log.Errorf("Error compiling %v: %v", inPath, err)
+				return err
+			}
+
+			articles[i] = article
+			return nil
+		})
 	}
 
-	return nil
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	return compactArticles(articles), nil
 }
 
-func compileFragments() error {
-	fragmentInfos, err := ioutil.ReadDir(sorg.FragmentsDir)
+// compileArticle compiles the single article found at inPath and renders
+// it to its target location, returning the compiled Article. It returns a
+// nil Article (with a nil error) for a draft that's being excluded from
+// this build, or one scheduled to publish in the future — the caller
+// treats that the same as a file that was filtered out up front.
+func compileArticle(inPath string) (*Article, error) {
+	log.Debugf("Compiling: %v", inPath)
+
+	outName := strings.Replace(filepath.Base(inPath), ".md", "", -1)
+
+	info, err := os.Stat(inPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, fragmentInfo := range fragmentInfos {
-		inPath := sorg.FragmentsDir + fragmentInfo.Name()
-		log.Debugf("Compiling: %v", inPath)
+	raw, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return nil, err
+	}
 
-		outName := strings.Replace(fragmentInfo.Name(), ".md", "", -1)
+	frontmatter, content, err := splitFrontmatter(string(raw))
+	if err != nil {
+		return nil, err
+	}
 
-		raw, err := ioutil.ReadFile(inPath)
-		if err != nil {
-			return err
-		}
+	var article Article
+	err = yaml.Unmarshal([]byte(frontmatter), &article)
+	if err != nil {
+		return nil, err
+	}
 
-		frontmatter, content, err := splitFrontmatter(string(raw))
-		if err != nil {
-			return err
-		}
+	if article.Title == "" {
+		return nil, fmt.Errorf("No title for article: %v", inPath)
+	}
 
-		var fragment Fragment
-		err = yaml.Unmarshal([]byte(frontmatter), &fragment)
-		if err != nil {
-			return err
-		}
+	if article.PublishedAt == nil {
+		return nil, fmt.Errorf("No publish date for article: %v", inPath)
+	}
+
+	if article.Draft && !conf.IncludeDrafts {
+		return nil, nil
+	}
+
+	if !conf.IncludeScheduled && article.PublishedAt.After(time.Now()) {
+		return nil, nil
+	}
+
+	html, toc, err := converter.Convert([]byte(content))
+	if err != nil {
+		return nil, err
+	}
 
-		if fragment.Title == "" {
-			return fmt.Errorf("No title for fragment: %v", inPath)
+	article.Content = string(html)
+	article.ModTime = info.ModTime()
+	article.Slug = outName
+	article.TOC = string(toc)
+
+	locals := getLocals(article.Title, map[string]interface{}{
+		"Article": article,
+		"NoIndex": article.Draft,
+	})
+
+	target := sorg.TargetArticlesDir + outName
+	if article.Draft {
+		target = sorg.TargetDir + "drafts/articles/" + outName
+	}
+
+	err = renderView(sorg.LayoutsDir+"main", sorg.ViewsDir+"/articles/show",
+		target, locals)
+	if err != nil {
+		return nil, err
+	}
+
+	return &article, nil
+}
+
+// compactArticles drops the nil entries left behind in articles by a
+// single-file compile, preserving the relative order of the rest.
+func compactArticles(articles []*Article) []*Article {
+	compacted := articles[:0]
+	for _, article := range articles {
+		if article != nil {
+			compacted = append(compacted, article)
 		}
+	}
+	return compacted
+}
 
-		if fragment.PublishedAt == nil {
-			return fmt.Errorf("No publish date for fragment: %v", inPath)
+// compileFragments compiles every fragment under sorg.FragmentsDir, or
+// just onlyFile if it's non-empty. See compileArticles for the concurrency
+// and error handling strategy, which is shared.
+func compileFragments(onlyFile string) ([]*Fragment, error) {
+	fragmentInfos, err := ioutil.ReadDir(sorg.FragmentsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	fragments := make([]*Fragment, len(fragmentInfos))
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+
+	group, ctx := errgroup.WithContext(context.Background())
+
+	for i, fragmentInfo := range fragmentInfos {
+		i := i
+		inPath := sorg.FragmentsDir + fragmentInfo.Name()
+
+		if onlyFile != "" && inPath != onlyFile {
+			continue
 		}
 
-		fragment.Content = string(renderMarkdown([]byte(content)))
+		group.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+
+			fragment, err := compileFragment(inPath)
+			if err != nil {
+				log.Errorf("Error compiling %v: %v", inPath, err)
+				return err
+			}
 
-		locals := getLocals(fragment.Title, map[string]interface{}{
-			"Fragment": fragment,
+			fragments[i] = fragment
+			return nil
 		})
+	}
 
-		err = renderView(sorg.LayoutsDir+"main", sorg.ViewsDir+"/fragments/show",
-			sorg.TargetFragmentsDir+outName, locals)
-		if err != nil {
-			return err
-		}
+	if err := group.Wait(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return compactFragments(fragments), nil
+}
+
+// compileFragment compiles the single fragment found at inPath and renders
+// it to its target location, returning the compiled Fragment. See
+// compileArticle for the meaning of a nil, nil return.
+func compileFragment(inPath string) (*Fragment, error) {
+	log.Debugf("Compiling: %v", inPath)
+
+	outName := strings.Replace(filepath.Base(inPath), ".md", "", -1)
+
+	info, err := os.Stat(inPath)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return nil, err
+	}
+
+	frontmatter, content, err := splitFrontmatter(string(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	var fragment Fragment
+	err = yaml.Unmarshal([]byte(frontmatter), &fragment)
+	if err != nil {
+		return nil, err
+	}
+
+	if fragment.Title == "" {
+		return nil, fmt.Errorf("No title for fragment: %v", inPath)
+	}
+
+	if fragment.PublishedAt == nil {
+		return nil, fmt.Errorf("No publish date for fragment: %v", inPath)
+	}
+
+	if fragment.Draft && !conf.IncludeDrafts {
+		return nil, nil
+	}
+
+	if !conf.IncludeScheduled && fragment.PublishedAt.After(time.Now()) {
+		return nil, nil
+	}
+
+	html, _, err := converter.Convert([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+
+	fragment.Content = string(html)
+	fragment.ModTime = info.ModTime()
+	fragment.Slug = outName
+
+	locals := getLocals(fragment.Title, map[string]interface{}{
+		"Fragment": fragment,
+		"NoIndex":  fragment.Draft,
+	})
+
+	target := sorg.TargetFragmentsDir + outName
+	if fragment.Draft {
+		target = sorg.TargetDir + "drafts/fragments/" + outName
+	}
+
+	err = renderView(sorg.LayoutsDir+"main", sorg.ViewsDir+"/fragments/show",
+		target, locals)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fragment, nil
+}
+
+// compactFragments drops the nil entries left behind in fragments by a
+// single-file compile, preserving the relative order of the rest.
+func compactFragments(fragments []*Fragment) []*Fragment {
+	compacted := fragments[:0]
+	for _, fragment := range fragments {
+		if fragment != nil {
+			compacted = append(compacted, fragment)
+		}
+	}
+	return compacted
 }
 
 // Gets a map of local values for use while rendering a template and includes
@@ -268,6 +653,7 @@ func getLocals(title string, locals map[string]interface{}) map[string]interface
 	defaults := map[string]interface{}{
 		"BodyClass":         "",
 		"GoogleAnalyticsID": conf.GoogleAnalyticsID,
+		"NoIndex":           false,
 		"Release":           sorg.Release,
 		"Title":             title,
 		"ViewportWidth":     "device-width",
@@ -483,6 +869,21 @@ func compileStylesheets() error {
 	defer outFile.Close()
 
 	for _, stylesheet := range stylesheets {
+		// Under the Goldmark engine, syntax highlighting is generated by
+		// Chroma rather than served from the checked-in Solarized Light
+		// stylesheet, so skip shipping the static file in that case.
+		if stylesheet == "solarized-light.css" && conf.MarkupEngine == "goldmark" {
+			css, err := markup.ChromaCSS()
+			if err != nil {
+				return err
+			}
+
+			outFile.WriteString("/* solarized-light.css (generated by chroma) */\n\n")
+			outFile.WriteString(css)
+			outFile.WriteString("\n\n")
+			continue
+		}
+
 		inPath := sorg.StylesheetsDir + stylesheet
 		log.Debugf("Compiling: %v", inPath)
 
@@ -546,33 +947,57 @@ func linkImageAssets() error {
 	return nil
 }
 
-func renderMarkdown(source []byte) []byte {
-	htmlFlags := 0
-	htmlFlags |= blackfriday.HTML_SMARTYPANTS_DASHES
-	htmlFlags |= blackfriday.HTML_SMARTYPANTS_FRACTIONS
-	htmlFlags |= blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
-	htmlFlags |= blackfriday.HTML_USE_SMARTYPANTS
-	htmlFlags |= blackfriday.HTML_USE_XHTML
-
-	extensions := 0
-	extensions |= blackfriday.EXTENSION_AUTO_HEADER_IDS
-	extensions |= blackfriday.EXTENSION_AUTOLINK
-	extensions |= blackfriday.EXTENSION_FENCED_CODE
-	extensions |= blackfriday.EXTENSION_HEADER_IDS
-	extensions |= blackfriday.EXTENSION_LAX_HTML_BLOCKS
-	extensions |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
-	extensions |= blackfriday.EXTENSION_TABLES
-	extensions |= blackfriday.EXTENSION_SPACE_HEADERS
-	extensions |= blackfriday.EXTENSION_STRIKETHROUGH
-
-	renderer := blackfriday.HtmlRenderer(htmlFlags, "", "")
-	return blackfriday.Markdown(source, renderer, extensions)
+// templateCacheKey identifies a compiled template by the layout/view pair
+// used to produce it.
+type templateCacheKey struct {
+	layout string
+	view   string
+}
+
+// templateCache memoizes compiled Ace templates across all calls to
+// renderView. This matters once rendering happens from multiple
+// goroutines: ace.Load is not safe to call concurrently for the same
+// layout/view pair, and repeating its (fairly expensive) work on every
+// single article or fragment is wasteful regardless.
+var (
+	templateCacheMu sync.RWMutex
+	templateCache   = map[templateCacheKey]*ace.Template{}
+)
+
+// loadTemplate returns the compiled template for layout/view, compiling
+// and caching it on first use.
+func loadTemplate(layout, view string) (*ace.Template, error) {
+	key := templateCacheKey{layout: layout, view: view}
+
+	templateCacheMu.RLock()
+	template, ok := templateCache[key]
+	templateCacheMu.RUnlock()
+	if ok {
+		return template, nil
+	}
+
+	templateCacheMu.Lock()
+	defer templateCacheMu.Unlock()
+
+	// Another goroutine may have compiled and cached the template while we
+	// were waiting on the write lock above.
+	if template, ok := templateCache[key]; ok {
+		return template, nil
+	}
+
+	template, err := ace.Load(layout, view, &ace.Options{FuncMap: templatehelpers.FuncMap})
+	if err != nil {
+		return nil, err
+	}
+
+	templateCache[key] = template
+	return template, nil
 }
 
 func renderView(layout, view, target string, locals map[string]interface{}) error {
 	log.Debugf("Rendering: %v", target)
 
-	template, err := ace.Load(layout, view, &ace.Options{FuncMap: templatehelpers.FuncMap})
+	template, err := loadTemplate(layout, view)
 	if err != nil {
 		return err
 	}
@@ -583,6 +1008,21 @@ func renderView(layout, view, target string, locals map[string]interface{}) erro
 	}
 	defer file.Close()
 
+	// When running under `serve`, a live reload snippet needs to be spliced
+	// into the rendered page, so the output has to be buffered rather than
+	// streamed straight through to disk.
+	if devMode {
+		var buf bytes.Buffer
+
+		err = template.Execute(&buf, locals)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.WriteString(injectLiveReload(buf.String()))
+		return err
+	}
+
 	writer := bufio.NewWriter(file)
 	defer writer.Flush()
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/brandur/sorg"
+	"github.com/brandur/sorg/markup"
+	"github.com/yosssi/ace"
+)
+
+// benchArticleCorpus sets up a corpus of numArticles source files plus the
+// minimal layout/view fixtures needed to render them, points the relevant
+// sorg directories at it, and returns a cleanup function that restores
+// them. It's shared by the sequential and concurrent benchmarks below so
+// that they're measuring like-for-like.
+func benchArticleCorpus(b *testing.B, numArticles int) func() {
+	b.Helper()
+
+	articlesDir, err := ioutil.TempDir("", "sorg-bench-articles")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	layoutsDir, err := ioutil.TempDir("", "sorg-bench-layouts")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	viewsDir, err := ioutil.TempDir("", "sorg-bench-views")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	targetArticlesDir, err := ioutil.TempDir("", "sorg-bench-target")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = os.MkdirAll(viewsDir+"/articles", 0755)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(layoutsDir+"/main.ace", []byte(
+		"= doctype html\nhtml\n  body\n    = yield\n"), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(viewsDir+"/articles/show.ace", []byte(
+		"h1= .Article.Title\n= unescaped .Article.Content\n"), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < numArticles; i++ {
+		content := fmt.Sprintf(`---
+title: "Article %d"
+published_at: 2018-01-01T00:00:00Z
+---
+
+# Article %d
+
+Some representative paragraph text, a [link](https://example.com), and a
+fenced code block, repeated across a corpus of %d articles so that the
+benchmark reflects a realistically sized site.
+
+`+"```go\nfunc main() {}\n```"+`
+`, i, i, numArticles)
+
+		path := fmt.Sprintf("%s/article-%04d.md", articlesDir, i)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	origArticlesDir := sorg.ArticlesDir
+	origLayoutsDir := sorg.LayoutsDir
+	origViewsDir := sorg.ViewsDir
+	origTargetArticlesDir := sorg.TargetArticlesDir
+
+	sorg.ArticlesDir = articlesDir + "/"
+	sorg.LayoutsDir = layoutsDir + "/"
+	sorg.ViewsDir = viewsDir
+	sorg.TargetArticlesDir = targetArticlesDir + "/"
+
+	converter = markup.NewBlackfridayConverter()
+
+	return func() {
+		sorg.ArticlesDir = origArticlesDir
+		sorg.LayoutsDir = origLayoutsDir
+		sorg.ViewsDir = origViewsDir
+		sorg.TargetArticlesDir = origTargetArticlesDir
+
+		os.RemoveAll(articlesDir)
+		os.RemoveAll(layoutsDir)
+		os.RemoveAll(viewsDir)
+		os.RemoveAll(targetArticlesDir)
+
+		templateCacheMu.Lock()
+		templateCache = map[templateCacheKey]*ace.Template{}
+		templateCacheMu.Unlock()
+	}
+}
+
+// BenchmarkCompileArticles exercises compileArticles (concurrent, bounded
+// by GOMAXPROCS) against a corpus of 120 articles. Run alongside
+// BenchmarkCompileArticlesSequential with `go test -bench .` to see the
+// wall-clock improvement from parallelizing the compile pipeline.
+func BenchmarkCompileArticles(b *testing.B) {
+	cleanup := benchArticleCorpus(b, 120)
+	defer cleanup()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := compileArticles(""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCompileArticlesSequential compiles the same corpus as
+// BenchmarkCompileArticles, but one article at a time, as a baseline for
+// comparison against the concurrent implementation.
+func BenchmarkCompileArticlesSequential(b *testing.B) {
+	cleanup := benchArticleCorpus(b, 120)
+	defer cleanup()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		articleInfos, err := ioutil.ReadDir(sorg.ArticlesDir)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, articleInfo := range articleInfos {
+			if _, err := compileArticle(sorg.ArticlesDir + articleInfo.Name()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/brandur/sorg"
+	"github.com/fsnotify/fsnotify"
+)
+
+// devMode is set while running under the `serve` subcommand. It causes
+// renderView to splice a live reload snippet into rendered pages.
+var devMode bool
+
+// lastArticles and lastFragments hold the full result of the last complete
+// compile. rebuild patches a single incremental change into these rather
+// than regenerating the Atom feeds from just the one recompiled article or
+// fragment, which would otherwise truncate the live feed down to a single
+// entry on every edit under `sorg serve`.
+var (
+	lastArticlesMu sync.Mutex
+	lastArticles   []*Article
+
+	lastFragmentsMu sync.Mutex
+	lastFragments   []*Fragment
+)
+
+// reloadInjection is injected into every page rendered in devMode. It opens
+// a Server-Sent Events connection to /_reload and reloads the page as soon
+// as the server signals that a rebuild has finished.
+const reloadInjection = `<script>
+(function() {
+	var source = new EventSource("/_reload");
+	source.onmessage = function() {
+		source.close();
+		window.location.reload();
+	};
+})();
+</script>`
+
+// injectLiveReload splices reloadInjection into a rendered page just before
+// its closing </body> tag, or appends it if none is found.
+func injectLiveReload(content string) string {
+	if i := strings.LastIndex(content, "</body>"); i >= 0 {
+		return content[:i] + reloadInjection + content[i:]
+	}
+	return content + reloadInjection
+}
+
+// reloadBroker fans a rebuild notification out to every browser currently
+// connected to /_reload.
+type reloadBroker struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]struct{}
+}
+
+func newReloadBroker() *reloadBroker {
+	return &reloadBroker{clients: make(map[chan struct{}]struct{})}
+}
+
+func (b *reloadBroker) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch
+}
+
+func (b *reloadBroker) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+}
+
+func (b *reloadBroker) broadcast() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *reloadBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	for {
+		select {
+		case <-ch:
+			fmt.Fprint(w, "data: reload\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serve runs the `sorg serve` subcommand: it builds the site once, then
+// watches source directories for changes, recompiling only the affected
+// content and live-reloading any connected browser over Server-Sent Events.
+func serve() error {
+	devMode = true
+
+	err := build()
+	if err != nil {
+		return err
+	}
+
+	articles, err := compileArticles("")
+	if err != nil {
+		return err
+	}
+	lastArticles = articles
+
+	fragments, err := compileFragments("")
+	if err != nil {
+		return err
+	}
+	lastFragments = fragments
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range []string{
+		sorg.ArticlesDir,
+		sorg.FragmentsDir,
+		sorg.StylesheetsDir,
+		sorg.LayoutsDir,
+		sorg.ViewsDir,
+		sorg.ImagesDir,
+	} {
+		err = addWatchRecursive(watcher, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	broker := newReloadBroker()
+
+	mux := http.NewServeMux()
+	mux.Handle("/_reload", broker)
+	mux.Handle("/", http.FileServer(http.Dir(sorg.TargetDir)))
+
+	server := &http.Server{Addr: ":5000", Handler: mux}
+
+	go func() {
+		log.Infof("Serving on %v", server.Addr)
+
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}()
+
+	go watchAndRebuild(watcher, broker)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	<-signals
+
+	log.Info("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
+
+// addWatchRecursive adds root and every directory beneath it to watcher.
+// fsnotify doesn't watch recursively on its own, so this is needed for any
+// watched tree (like sorg.ViewsDir) that's nested more than one level deep.
+func addWatchRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// watchAndRebuild consumes fsnotify events until watcher is closed,
+// triggering an incremental rebuild for each one. A newly created directory
+// is added to the watch list on the spot, so that subtrees created after
+// `sorg serve` starts (e.g. a new views subdirectory) are still watched.
+func watchAndRebuild(watcher *fsnotify.Watcher, broker *reloadBroker) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := addWatchRecursive(watcher, event.Name); err != nil {
+						log.Error(err)
+					}
+					continue
+				}
+			}
+
+			err := rebuild(event.Name)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+
+			broker.broadcast()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error(err)
+		}
+	}
+}
+
+// rebuild recompiles whatever part of the site is affected by a change to
+// name, reusing the single-file mode of compileArticles/compileFragments
+// where possible instead of rebuilding the entire site.
+func rebuild(name string) error {
+	log.Debugf("Change detected: %v", name)
+
+	switch {
+	case strings.HasPrefix(name, sorg.ArticlesDir) && strings.HasSuffix(name, ".md"):
+		return rebuildArticle(name)
+
+	case strings.HasPrefix(name, sorg.FragmentsDir) && strings.HasSuffix(name, ".md"):
+		return rebuildFragment(name)
+
+	case strings.HasPrefix(name, sorg.StylesheetsDir):
+		return compileStylesheets()
+
+	default:
+		return build()
+	}
+}
+
+// rebuildArticle recompiles the single article at inPath and patches the
+// result into lastArticles (replacing any prior entry with the same slug,
+// or dropping it if the article is now a filtered-out draft) before
+// regenerating the Atom feed from the full set. Feeding the feed writer
+// the single-file compile result directly would truncate it down to just
+// the one changed article.
+func rebuildArticle(inPath string) error {
+	articles, err := compileArticles(inPath)
+	if err != nil {
+		return err
+	}
+
+	lastArticlesMu.Lock()
+	lastArticles = replaceArticle(lastArticles, inPath, articles)
+	full := append([]*Article(nil), lastArticles...)
+	lastArticlesMu.Unlock()
+
+	public, _ := partitionArticleDrafts(full)
+	return compileArticlesFeed(public)
+}
+
+// rebuildFragment is rebuildArticle's counterpart for fragments.
+func rebuildFragment(inPath string) error {
+	fragments, err := compileFragments(inPath)
+	if err != nil {
+		return err
+	}
+
+	lastFragmentsMu.Lock()
+	lastFragments = replaceFragment(lastFragments, inPath, fragments)
+	full := append([]*Fragment(nil), lastFragments...)
+	lastFragmentsMu.Unlock()
+
+	public, _ := partitionFragmentDrafts(full)
+	return compileFragmentsFeed(public)
+}
+
+// replaceArticle returns existing with any entry matching the slug for
+// inPath removed, and the freshly compiled article (if any — compiled is
+// empty for a draft or scheduled article that got filtered out) appended.
+func replaceArticle(existing []*Article, inPath string, compiled []*Article) []*Article {
+	slug := strings.Replace(filepath.Base(inPath), ".md", "", -1)
+
+	updated := make([]*Article, 0, len(existing)+1)
+	for _, article := range existing {
+		if article.Slug != slug {
+			updated = append(updated, article)
+		}
+	}
+
+	if len(compiled) > 0 {
+		updated = append(updated, compiled[0])
+	}
+
+	return updated
+}
+
+// replaceFragment is replaceArticle's counterpart for fragments.
+func replaceFragment(existing []*Fragment, inPath string, compiled []*Fragment) []*Fragment {
+	slug := strings.Replace(filepath.Base(inPath), ".md", "", -1)
+
+	updated := make([]*Fragment, 0, len(existing)+1)
+	for _, fragment := range existing {
+		if fragment.Slug != slug {
+			updated = append(updated, fragment)
+		}
+	}
+
+	if len(compiled) > 0 {
+		updated = append(updated, compiled[0])
+	}
+
+	return updated
+}
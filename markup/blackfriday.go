@@ -0,0 +1,51 @@
+package markup
+
+import (
+	"github.com/russross/blackfriday"
+)
+
+// BlackfridayConverter is a Converter backed by russross/blackfriday. It
+// preserves the rendering behavior sorg used before the introduction of
+// the Converter abstraction and remains the default engine.
+type BlackfridayConverter struct {
+}
+
+// NewBlackfridayConverter builds a BlackfridayConverter.
+func NewBlackfridayConverter() *BlackfridayConverter {
+	return &BlackfridayConverter{}
+}
+
+// Convert implements Converter.
+func (c *BlackfridayConverter) Convert(source []byte) ([]byte, TOC, error) {
+	content := blackfriday.Markdown(source, blackfridayRenderer(0), blackfridayExtensions)
+
+	// Rendered again with the HTML_TOC flag set (and HTML_OMIT_CONTENTS so
+	// that only the table of contents comes back) to produce a standalone
+	// TOC that can be dropped into a template separately from the body.
+	toc := blackfriday.Markdown(source,
+		blackfridayRenderer(blackfriday.HTML_TOC|blackfriday.HTML_OMIT_CONTENTS),
+		blackfridayExtensions)
+
+	return content, TOC(toc), nil
+}
+
+const blackfridayExtensions = blackfriday.EXTENSION_AUTO_HEADER_IDS |
+	blackfriday.EXTENSION_AUTOLINK |
+	blackfriday.EXTENSION_FENCED_CODE |
+	blackfriday.EXTENSION_HEADER_IDS |
+	blackfriday.EXTENSION_LAX_HTML_BLOCKS |
+	blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+	blackfriday.EXTENSION_TABLES |
+	blackfriday.EXTENSION_SPACE_HEADERS |
+	blackfriday.EXTENSION_STRIKETHROUGH
+
+func blackfridayRenderer(extraFlags int) blackfriday.Renderer {
+	htmlFlags := extraFlags
+	htmlFlags |= blackfriday.HTML_SMARTYPANTS_DASHES
+	htmlFlags |= blackfriday.HTML_SMARTYPANTS_FRACTIONS
+	htmlFlags |= blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
+	htmlFlags |= blackfriday.HTML_USE_SMARTYPANTS
+	htmlFlags |= blackfriday.HTML_USE_XHTML
+
+	return blackfriday.HtmlRenderer(htmlFlags, "", "")
+}
@@ -0,0 +1,90 @@
+package markup
+
+import (
+	"bytes"
+
+	toc "github.com/abhinav/goldmark-toc"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// GoldmarkConverter is a Converter backed by yuin/goldmark. It's opted
+// into via the MARKUP_ENGINE environment variable and is meant to
+// eventually replace BlackfridayConverter as the site's default.
+type GoldmarkConverter struct {
+	md goldmark.Markdown
+}
+
+// NewGoldmarkConverter builds a GoldmarkConverter with sorg's standard set
+// of extensions: GitHub-flavored Markdown (tables, strikethrough,
+// autolinks, task lists), footnotes, definition lists, and typographic
+// substitutions, plus Chroma-based syntax highlighting for fenced code
+// blocks (replacing the old checked-in solarized-light.css).
+func NewGoldmarkConverter() *GoldmarkConverter {
+	md := goldmark.New(
+		goldmark.WithExtensions(
+			extension.GFM,
+			extension.Footnote,
+			extension.DefinitionList,
+			extension.Typographer,
+			highlighting.NewHighlighting(
+				highlighting.WithStyle("solarized-light"),
+				highlighting.WithFormatOptions(
+					chromahtml.WithClasses(true),
+					chromahtml.WithLineNumbers(false),
+				),
+			),
+		),
+		goldmark.WithParserOptions(
+			parser.WithAutoHeadingID(),
+		),
+	)
+
+	return &GoldmarkConverter{md: md}
+}
+
+// Convert implements Converter.
+func (c *GoldmarkConverter) Convert(source []byte) ([]byte, TOC, error) {
+	reader := text.NewReader(source)
+	doc := c.md.Parser().Parse(reader)
+
+	tocTree, err := toc.Inspect(doc, source)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var tocBuf bytes.Buffer
+	if list := toc.RenderList(tocTree); list != nil {
+		if err := c.md.Renderer().Render(&tocBuf, source, list); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := c.md.Renderer().Render(&buf, source, doc); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), TOC(tocBuf.String()), nil
+}
+
+// ChromaCSS returns the CSS needed to style Chroma's syntax-highlighted
+// code blocks under the "solarized-light" style, for inclusion in the
+// compiled stylesheet bundle.
+func ChromaCSS() (string, error) {
+	var buf bytes.Buffer
+
+	formatter := chromahtml.New(chromahtml.WithLineNumbers(false))
+	style := styles.Get("solarized-light")
+
+	if err := formatter.WriteCSS(&buf, style); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
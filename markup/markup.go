@@ -0,0 +1,18 @@
+// Package markup abstracts over the Markdown rendering backend that sorg
+// uses to turn an article or fragment's source into rendered HTML. It
+// exists so that the site can be moved incrementally from Blackfriday to
+// Goldmark (see BlackfridayConverter and GoldmarkConverter) without
+// disturbing the rest of the compile pipeline.
+package markup
+
+// TOC is an HTML-rendered table of contents generated alongside a
+// document's content.
+type TOC string
+
+// Converter renders Markdown source to HTML and produces a table of
+// contents from the document's headers.
+type Converter interface {
+	// Convert renders source (Markdown) to HTML and returns the document's
+	// table of contents alongside it.
+	Convert(source []byte) ([]byte, TOC, error)
+}